@@ -1,12 +1,13 @@
 package main
 
 import (
-	"bytes"
-	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
 	"path/filepath"
 	"strings"
@@ -60,6 +61,7 @@ func apiServer(options apiServerCmd) {
 	downRouter := mux.NewRouter()
 	downRouter.HandleFunc("/fetch/{id}", APIDownloadHandler).Methods("GET")
 	downRouter.HandleFunc("/fetch/{id}", APIDownloadHandler).Methods("HEAD")
+	downRouter.HandleFunc("/lookup/{id}", LookupHandler).Methods("GET")
 	downRouter.PathPrefix("/").HandlerFunc(APIMissingHandler)
 
 	// The following code is a hack to allow us to run two distinct HTTP-servers on different ports.
@@ -77,74 +79,112 @@ func apiServer(options apiServerCmd) {
 	wg.Wait()
 }
 
-// This is a helper for allowing us to consume a HTTP-body more than once.
-type myReader struct {
-	*bytes.Buffer
-}
-
-// So that it implements the io.ReadCloser interface
-func (m myReader) Close() error { return nil }
-
 // APIUploadHandler handles uploads to the API server.
 //
-// This should attempt to upload against the blob-servers and return when that is complete.  If
-// there is a failure then it should repeat the process until all known servers are exhausted.
+// The body is streamed, not buffered: req.Body is wrapped in an io.TeeReader feeding
+// a sha256 hash, and fanned out through an io.MultiWriter of pipes, one per replica,
+// each read from by its own goroutine POSTing to a blob-server's content-addressed
+// "POST /blob" endpoint - so memory use is O(chunk) rather than O(blob) regardless of
+// how many replicas we write to.
 //
-// The retry logic is described in the file `SCALING.md` in the repository, but in brief there are
-// two cases:
-//  * All the servers are in the group `default`.
-//  * There are N defined groups.
-//
-// Both cases are handled by the call to OrderedServers() which returns the known blob-servers in a
-// suitable order to minimize lookups.  See `SCALING.md` for more details.
+// Replicas are chosen uniformly at random from the known server-list, since the
+// blob's real content-digest isn't known until the stream has been fully read and
+// so can't drive placement; every replica computes and stores under that digest
+// itself (see chunk0-1).  We only commit once every chosen replica has ACKed with
+// a 2xx, and only trust our own sha256 over what actually went out the door for
+// the ID we record.
 func APIUploadHandler(res http.ResponseWriter, req *http.Request) {
-	buf, _ := ioutil.ReadAll(req.Body)
-
-	// Create a copy of the buffer, so that we can consume it initially to hash the data.
-	rdr1 := myReader{bytes.NewBuffer(buf)}
-	hasher := sha1.New()
-	b, _ := ioutil.ReadAll(rdr1)
-	hasher.Write([]byte(b))
-	hash := hasher.Sum(nil)
-
-	// We try each blob-server in turn, and if/when we receive a successful result we'll return it to
-	// the caller.
-	for _, s := range libconfig.OrderedServers() {
-		rdr2 := myReader{bytes.NewBuffer(buf)}
-		req.Body = rdr2
-
-		// This is where we'll POST to.
-		url := fmt.Sprintf("%s%s%x", s.Location, "/blob/", hash)
-		child, _ := http.NewRequest("POST", url, req.Body)
-		client := &http.Client{}
-		r, err := client.Do(child)
-		if err != nil {
-			continue
+	replicas := pickReplicas(libconfig.Servers(), OPTIONS.replicationFactor)
+
+	if len(replicas) == 0 {
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "{\"error\":\"no blob-servers configured\"}")
+		return
+	}
+
+	hasher := sha256.New()
+	tee := io.TeeReader(req.Body, hasher)
+
+	readers := make([]*io.PipeReader, len(replicas))
+	writers := make([]io.Writer, len(replicas))
+	for i := range replicas {
+		pr, pw := io.Pipe()
+		readers[i] = pr
+		writers[i] = pw
+	}
+
+	type result struct {
+		location Location
+		ok       bool
+	}
+	results := make(chan result, len(replicas))
+
+	var wg sync.WaitGroup
+	for i, s := range replicas {
+		wg.Add(1)
+		go func(i int, s libconfig.Server) {
+			defer wg.Done()
+
+			client := &http.Client{}
+			child, _ := http.NewRequest("POST", s.Location+"/blob", readers[i])
+			r, err := client.Do(child)
+			if err != nil {
+				io.Copy(ioutil.Discard, readers[i])
+				results <- result{ok: false}
+				return
+			}
+			defer r.Body.Close()
+			ioutil.ReadAll(r.Body)
+			ok := r.StatusCode >= 200 && r.StatusCode < 300
+			results <- result{location: Location{Group: s.Group, URL: s.Location}, ok: ok}
+		}(i, s)
+	}
+
+	mw := io.MultiWriter(writers...)
+	_, copyErr := io.Copy(mw, tee)
+	for _, w := range writers {
+		if copyErr != nil {
+			w.(*io.PipeWriter).CloseWithError(copyErr)
+		} else {
+			w.(*io.PipeWriter).Close()
 		}
+	}
+
+	wg.Wait()
+	close(results)
 
-		response, _ := ioutil.ReadAll(r.Body)
-		if response != nil {
-			fmt.Fprintf(res, string(response))
+	var locations []Location
+	for r := range results {
+		if !r.ok {
+			res.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(res, "{\"error\":\"upload failed\"}")
 			return
 		}
+		locations = append(locations, r.location)
 	}
-	res.WriteHeader(http.StatusInternalServerError)
-	fmt.Fprintf(res, "{\"error\":\"upload failed\"}")
-	return
+
+	// Every replica ACKed, but if reading the client's body failed partway through
+	// they all ACKed a truncated blob - don't hand back an ID for that.
+	if copyErr != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "{\"error\":\"upload failed\"}")
+		return
+	}
+
+	id := fmt.Sprintf("sha256:%x", hasher.Sum(nil))
+	theLookupCache.put(id, locations)
+
+	out := fmt.Sprintf("{\"id\":\"%s\",\"status\":\"OK\"}", id)
+	fmt.Fprintf(res, out)
 }
 
 // APIDownloadHandler handles downloads from the API server.
 //
-// This should attempt to download against the blob-servers and return when that is complete.  If
-// there is a failure then it should repeat the process until all known servers are exhausted..
-//
-// The retry logic is described in the file `SCALING.md` in the repository, but in brief there are
-// two cases:
-//  * All the servers are in the group `default`.
-//  * There are N defined groups.
-//
-// Both cases are handled by the call to OrderedServers() which returns the known blob-servers in a
-// suitable order to minimize lookups.  See `SCALING.md` for more details.
+// This consults the lookup cache for the blob's known replica locations, falling
+// back to probeLocations() on a miss, then picks one of those locations at random
+// to serve from - SeaweedFS-style - rather than always trying servers in a fixed
+// order.  An optional `?redirect=1` returns a 307 to the chosen blob-server instead
+// of proxying the bytes, so large downloads can bypass the API-server entirely.
 func APIDownloadHandler(res http.ResponseWriter, req *http.Request) {
 	// The ID of the file we're to retrieve.
 	vars := mux.Vars(req)
@@ -154,41 +194,103 @@ func APIDownloadHandler(res http.ResponseWriter, req *http.Request) {
 	extension := filepath.Ext(id)
 	id = id[0 : len(id)-len(extension)]
 
-	for _, s := range libconfig.OrderedServers() {
-		if OPTIONS.verbose {
-			fmt.Printf("Attempting retrieval from %s%s%s\n", s.Location, "/blob/", id)
+	locations, ok := theLookupCache.get(id)
+	if !ok {
+		locations = probeLocations(id)
+		if len(locations) > 0 {
+			theLookupCache.put(id, locations)
 		}
+	}
 
-		response, err := http.Get(fmt.Sprintf("%s%s%s", s.Location, "/blob/", id))
-		if err != nil || response.StatusCode != 200 {
-			if err != nil && OPTIONS.verbose {
-				fmt.Printf("\tError fetching: %s\n", err.Error())
-			} else {
-				// If there was no error then the HTTP-connection to the back-end succeeded, but that didn't
-				// return a 200 OK. This might happen if a file was uploaded to only one host, but we've hit
-				// another.
-				if OPTIONS.verbose {
-					fmt.Printf("\tStatus Code : %d\n", response.StatusCode)
-				}
-			}
-		} else {
-			body, _ := ioutil.ReadAll(response.Body)
-			if body != nil {
-				if OPTIONS.verbose {
-					fmt.Printf("\tFound, read %d bytes\n", len(body))
-				}
-				if req.Method == "HEAD" {
-					res.Header().Set("Connection", "close")
-					res.WriteHeader(http.StatusOK)
-					return
-				}
-				io.Copy(res, bytes.NewReader(body))
-				return
-			}
+	if len(locations) == 0 {
+		res.Header().Set("Connection", "close")
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	chosen := locations[rand.Intn(len(locations))]
+	if OPTIONS.verbose {
+		fmt.Printf("Serving %s from %s\n", id, chosen.URL)
+	}
+
+	if req.URL.Query().Get("redirect") == "1" {
+		http.Redirect(res, req, chosen.URL+"/blob/"+id, http.StatusTemporaryRedirect)
+		return
+	}
+
+	// Forward the client's Range/If-None-Match straight through to the blob-server,
+	// so it can decide whether to send a 304, a 206 partial body, or the full blob.
+	child, _ := http.NewRequest("GET", chosen.URL+"/blob/"+id, nil)
+	if rng := req.Header.Get("Range"); rng != "" {
+		child.Header.Set("Range", rng)
+	}
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		child.Header.Set("If-None-Match", inm)
+	}
+
+	client := &http.Client{}
+	response, err := client.Do(child)
+	if err != nil {
+		res.Header().Set("Connection", "close")
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusNotModified:
+		// Fine, handled below.
+	default:
+		res.Header().Set("Connection", "close")
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	for _, h := range []string{"Content-Length", "Content-Type", "Content-Range", "Digest", "ETag"} {
+		if v := response.Header.Get(h); v != "" {
+			res.Header().Set(h, v)
 		}
 	}
-	res.Header().Set("Connection", "close")
-	res.WriteHeader(http.StatusNotFound)
+
+	if req.Method == "HEAD" {
+		res.Header().Set("Connection", "close")
+		res.WriteHeader(http.StatusOK)
+		return
+	}
+
+	res.WriteHeader(response.StatusCode)
+	io.Copy(res, response.Body)
+}
+
+// LookupHandler reports the known replica locations of a blob, so that clients who
+// don't want the API-server to proxy bytes for them can talk to a blob-server
+// directly.
+// This is called with requests like `GET /lookup/{id}`.
+func LookupHandler(res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	id := vars["id"]
+
+	locations, ok := theLookupCache.get(id)
+	if !ok {
+		locations = probeLocations(id)
+		if len(locations) > 0 {
+			theLookupCache.put(id, locations)
+		}
+	}
+
+	if len(locations) == 0 {
+		http.NotFound(res, req)
+		return
+	}
+
+	out := struct {
+		ID        string     `json:"id"`
+		Locations []Location `json:"locations"`
+	}{ID: id, Locations: locations}
+
+	b, _ := json.Marshal(out)
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(b)
 }
 
 // APIMissingHandler is a fall-back handler for all requests which are neither upload nor download.
@@ -0,0 +1,211 @@
+// Proves that APIUploadHandler/APIDownloadHandler hold O(chunk) memory regardless of
+// blob size, rather than buffering the whole body - the point of the streaming
+// refactor in chunk0-5.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/skx/sos/libconfig"
+)
+
+// blobSize is large enough (1 GiB) that buffering it whole would dominate any
+// reasonable heap-growth budget. With the pacing below the test takes several
+// minutes: the upload is read 32 KiB at a time with an 8ms pause per read, and the
+// download 8 KiB at a time with a 1ms pause per read.
+const blobSize = 1 << 30
+
+// pacedZeroReader produces n zero bytes in bounded-size chunks, sleeping briefly
+// between each one. The pacing is what makes this test meaningful: it stretches a
+// transfer that would otherwise finish quickly out long enough
+// for a concurrent goroutine to actually observe the heap mid-flight, rather than
+// only before the transfer starts and after it's long done.
+type pacedZeroReader struct {
+	remaining int64
+	chunk     int64
+	delay     time.Duration
+}
+
+func (z *pacedZeroReader) Read(p []byte) (int, error) {
+	if z.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > z.chunk {
+		p = p[:z.chunk]
+	}
+	if int64(len(p)) > z.remaining {
+		p = p[:z.remaining]
+	}
+	n := len(p)
+	for i := range p {
+		p[i] = 0
+	}
+	z.remaining -= int64(n)
+	time.Sleep(z.delay)
+	return n, nil
+}
+
+func newPacedZeroReader(remaining int64) *pacedZeroReader {
+	return &pacedZeroReader{remaining: remaining, chunk: 4 << 20, delay: 8 * time.Millisecond}
+}
+
+func TestStreamingUploadDownloadMemoryIsBounded(t *testing.T) {
+	if testing.Short() {
+		t.Skip("streaming a 1 GiB blob, skipped under -short")
+	}
+
+	dir, err := ioutil.TempDir("", "sos-api-mem-test")
+	if err != nil {
+		t.Fatalf("tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	blobStorage := new(FilesystemStorage)
+	blobStorage.Setup(dir)
+	STORAGE = blobStorage
+
+	replica := httptest.NewServer(newBlobRouter())
+	defer replica.Close()
+
+	libconfig.AddServer("default", replica.URL)
+	OPTIONS = apiServerCmd{replicationFactor: 1}
+
+	upRouter := mux.NewRouter()
+	upRouter.HandleFunc("/upload", APIUploadHandler).Methods("POST")
+	downRouter := mux.NewRouter()
+	downRouter.HandleFunc("/fetch/{id}", APIDownloadHandler).Methods("GET")
+	downServer := httptest.NewServer(downRouter)
+	defer downServer.Close()
+
+	baseline := heapInUse()
+
+	// peakDuring runs fn while a background goroutine repeatedly samples
+	// runtime.MemStats, and returns the largest HeapInuse it observed - this is
+	// the whole point: a handler that buffers the full blob before forwarding it
+	// holds that buffer live for the duration of fn, so the peak sampled while
+	// fn is still running catches it even though a single before/after snapshot,
+	// taken only once fn has returned and the buffer has become garbage, would not.
+	peakDuring := func(fn func()) uint64 {
+		var peak uint64
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			ticker := time.NewTicker(2 * time.Millisecond)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+					var m runtime.MemStats
+					runtime.ReadMemStats(&m)
+					for {
+						old := atomic.LoadUint64(&peak)
+						if m.HeapInuse <= old || atomic.CompareAndSwapUint64(&peak, old, m.HeapInuse) {
+							break
+						}
+					}
+				}
+			}
+		}()
+
+		fn()
+
+		close(stop)
+		<-done
+		return peak
+	}
+
+	var uploadRec *httptest.ResponseRecorder
+	uploadPeak := peakDuring(func() {
+		uploadReq := httptest.NewRequest("POST", "/upload", newPacedZeroReader(blobSize))
+		uploadRec = httptest.NewRecorder()
+		upRouter.ServeHTTP(uploadRec, uploadReq)
+	})
+
+	if uploadRec.Code != http.StatusOK {
+		t.Fatalf("upload: got status %d, body %q", uploadRec.Code, uploadRec.Body.String())
+	}
+
+	if grew := uploadPeak - baseline; grew > blobSize/4 {
+		t.Fatalf("upload's in-flight heap grew by %d bytes for a %d byte blob - looks buffered, not streamed", grew, blobSize)
+	}
+
+	var uploadResponse struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(uploadRec.Body.Bytes(), &uploadResponse); err != nil {
+		t.Fatalf("parsing upload response %q: %v", uploadRec.Body.String(), err)
+	}
+
+	// A real server/client round-trip (rather than httptest.NewRecorder, which
+	// buffers the whole response body in memory regardless of how the handler
+	// wrote it) so streaming on the download side is actually being measured.
+	afterUpload := heapInUse()
+	var downloaded int64
+	downloadPeak := peakDuring(func() {
+		resp, err := http.Get(downServer.URL + "/fetch/" + uploadResponse.ID)
+		if err != nil {
+			t.Fatalf("download: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("download: got status %d", resp.StatusCode)
+		}
+
+		// A slow reader on our side keeps the download in flight long enough for
+		// the sampling goroutine to catch the handler's heap usage mid-transfer.
+		downloaded, err = io.Copy(ioutil.Discard, &pacedReader{r: resp.Body, delay: time.Millisecond})
+		if err != nil {
+			t.Fatalf("download: %v", err)
+		}
+	})
+
+	if downloaded != blobSize {
+		t.Fatalf("download: got %d bytes, want %d", downloaded, blobSize)
+	}
+
+	if grew := downloadPeak - afterUpload; grew > blobSize/4 {
+		t.Fatalf("download's in-flight heap grew by %d bytes for a %d byte blob - looks buffered, not streamed", grew, blobSize)
+	}
+}
+
+// pacedReader wraps r, sleeping delay between each chunk read from it, so a
+// response body that would otherwise drain in a fraction of a second stays open
+// long enough for a concurrent heap sample to observe the server's side mid-flight.
+type pacedReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (p *pacedReader) Read(b []byte) (int, error) {
+	if len(b) > 1<<20 {
+		b = b[:1<<20]
+	}
+	n, err := p.r.Read(b)
+	time.Sleep(p.delay)
+	return n, err
+}
+
+// heapInUse forces a GC and returns the current heap size, so growth between two
+// calls reflects retained allocations rather than garbage awaiting collection. Only
+// suitable as a steady-state baseline - see peakDuring for measuring mid-transfer.
+func heapInUse() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapInuse
+}
@@ -10,10 +10,87 @@ import (
 	"log"
 	"net/http"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
+// idPattern matches the IDs we're prepared to store/serve.  Plain alphanumeric IDs
+// are allowed, as are content-digests of the form "algo:hex", e.g. "sha256:deadbeef".
+var idPattern = regexp.MustCompile(`^([a-z0-9]+:)?[a-z0-9]+$`)
+
+// parseRange parses a "Range: bytes=..." header against a resource of the given
+// total size, returning the offset and length it describes.  Only a single range is
+// supported; if the caller asks for more than one (comma-separated) we just honour
+// the first, which is the common case browsers and resumable-download clients hit.
+func parseRange(header string, size int64) (start, length int64, ok bool) {
+	header = strings.TrimPrefix(header, "bytes=")
+	spec := strings.SplitN(header, ",", 2)[0]
+	parts := strings.SplitN(spec, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+
+	if parts[0] == "" {
+		// A suffix range, e.g. "-500", meaning the last 500 bytes.
+		n, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true
+	}
+
+	s, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || s < 0 || s >= size {
+		return 0, 0, false
+	}
+
+	end := size - 1
+	if parts[1] != "" {
+		if e, err := strconv.ParseInt(parts[1], 10, 64); err == nil && e < end {
+			end = e
+		}
+	}
+
+	return s, end - s + 1, true
+}
+
+// serveRangeViaStorage serves a Range request straight from a RangeStorage-capable
+// back-end, without reading the unwanted parts of the blob into memory.  It reports
+// whether it handled the request at all, so GetHandler can fall back to Get() plus
+// slicing for back-ends (or IDs) it can't serve this way.
+func serveRangeViaStorage(res http.ResponseWriter, rs RangeStorage, id, rangeHeader string) bool {
+	sizer, total, err := rs.GetRange(id, 0, 0)
+	if err != nil {
+		return false
+	}
+	sizer.Close()
+
+	start, length, ok := parseRange(rangeHeader, total)
+	if !ok {
+		res.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+		res.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return true
+	}
+
+	rc, _, err := rs.GetRange(id, start, length)
+	if err != nil {
+		return false
+	}
+	defer rc.Close()
+
+	res.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, total))
+	res.Header().Set("Content-Length", fmt.Sprintf("%d", length))
+	res.WriteHeader(http.StatusPartialContent)
+	io.Copy(res, rc)
+	return true
+}
+
 // STORAGE holds a handle to our selected storage-method.
 var STORAGE StorageHandler
 
@@ -37,8 +114,7 @@ func GetHandler(res http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	id := vars["id"]
 
-	r, _ := regexp.Compile("^([a-z0-9]+)$")
-	if !r.MatchString(id) {
+	if !idPattern.MatchString(id) {
 		status = http.StatusInternalServerError
 		err = errors.New("alphanumeric IDs only")
 		return
@@ -52,22 +128,82 @@ func GetHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// If id is a content-digest, that digest IS the blob's sha256 (storage is
+	// content-addressable and verifies this on write - see chunk0-1/chunk0-3), so we
+	// can serve Digest/ETag and honour If-None-Match off the id alone, without
+	// reading the blob at all.  This has to happen before the RangeStorage branch
+	// below, or a conditional range request against it would never see a 304.
+	var digest string
+	if idx := strings.Index(id, ":"); idx != -1 && id[:idx] == "sha256" {
+		digest = id
+	}
+	if digest != "" {
+		etag := fmt.Sprintf("%q", digest)
+		res.Header().Set("Digest", digest)
+		res.Header().Set("ETag", etag)
+		if req.Header.Get("If-None-Match") == etag {
+			res.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	rangeHeader := req.Header.Get("Range")
+
+	// If our back-end can serve a sub-range directly, prefer that: it avoids
+	// reading the rest of a (possibly huge) blob into memory just to discard it.
+	if rs, ok := STORAGE.(RangeStorage); ok && rangeHeader != "" {
+		if serveRangeViaStorage(res, rs, id, rangeHeader) {
+			return
+		}
+	}
+
 	data, meta := STORAGE.Get(id)
 	if data == nil {
 		http.NotFound(res, req)
-	} else {
-		if meta != nil {
-			for k, v := range meta {
-				// Special case to set the content-type of the returned value.
-				if k == "X-Mime-Type" {
-					res.Header().Set(k, v)
-					k = "Content-Type"
-				}
+		return
+	}
+
+	// Plain (non-digest) IDs have no cheap digest source, so compute and check it
+	// here instead, now that we've read the body anyway.
+	if digest == "" {
+		digest = Digest(*data)
+		etag := fmt.Sprintf("%q", digest)
+		res.Header().Set("Digest", digest)
+		res.Header().Set("ETag", etag)
+
+		if req.Header.Get("If-None-Match") == etag {
+			res.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	if meta != nil {
+		for k, v := range meta {
+			// Special case to set the content-type of the returned value.
+			if k == "X-Mime-Type" {
 				res.Header().Set(k, v)
+				k = "Content-Type"
 			}
+			res.Header().Set(k, v)
 		}
-		io.Copy(res, bytes.NewReader(*data))
 	}
+
+	if rangeHeader != "" {
+		size := int64(len(*data))
+		start, length, ok := parseRange(rangeHeader, size)
+		if !ok {
+			res.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			res.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		res.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+		res.Header().Set("Content-Length", fmt.Sprintf("%d", length))
+		res.WriteHeader(http.StatusPartialContent)
+		io.Copy(res, bytes.NewReader((*data)[start:start+length]))
+		return
+	}
+
+	io.Copy(res, bytes.NewReader(*data))
 }
 
 func MissingHandler(res http.ResponseWriter, req *http.Request) {
@@ -96,9 +232,9 @@ func UploadHandler(res http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	id := vars["id"]
 
-	// Ensure the ID is entirely alphanumeric, to prevent traversal attacks.
-	r, _ := regexp.Compile("^([a-z0-9]+)$")
-	if !r.MatchString(id) {
+	// Ensure the ID is entirely alphanumeric, or a content-digest, to prevent traversal
+	// attacks.
+	if !idPattern.MatchString(id) {
 		err = errors.New("alphanumeric IDs only")
 		status = http.StatusInternalServerError
 		return
@@ -112,6 +248,13 @@ func UploadHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// If the caller gave us a content-digest as the ID, verify that the body actually
+	// hashes to it before we commit anything to storage.
+	if err = VerifyDigest(id, content); err != nil {
+		status = http.StatusBadRequest
+		return
+	}
+
 	if ok := STORAGE.Store(id, content); !ok {
 		err = errors.New("failed to write to storage")
 		status = http.StatusInternalServerError
@@ -127,24 +270,204 @@ func UploadHandler(res http.ResponseWriter, req *http.Request) {
 	fmt.Fprintf(res, string(out))
 }
 
+// DigestUploadHandler allows a blob to be uploaded without the caller naming an ID.
+// This is called with requests like `POST /blob`; the server hashes the body itself,
+// stores the blob under the resulting digest, and reports that digest back so the
+// caller can retrieve it later - mirroring how the Docker registry keys blobs.
+func DigestUploadHandler(res http.ResponseWriter, req *http.Request) {
+	var (
+		status int
+		err    error
+	)
+	defer func() {
+		if nil != err {
+			http.Error(res, err.Error(), status)
+		}
+	}()
+
+	content, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		err = errors.New("failed to read body")
+		status = http.StatusInternalServerError
+		return
+	}
+
+	id := Digest(content)
+	if ok := STORAGE.Store(id, content); !ok {
+		err = errors.New("failed to write to storage")
+		status = http.StatusInternalServerError
+		return
+	}
+
+	out := fmt.Sprintf("{\"digest\":\"%s\",\"size\":%d}", id, len(content))
+	fmt.Fprintf(res, string(out))
+}
+
+// parseContentRangeStart extracts the start offset from a Content-Range header of the
+// form "bytes start-end/total" or "bytes start-end/*".
+func parseContentRangeStart(header string) (int64, bool) {
+	if header == "" {
+		return 0, false
+	}
+	header = strings.TrimPrefix(header, "bytes ")
+	span := strings.SplitN(header, "/", 2)[0]
+	parts := strings.SplitN(span, "-", 2)
+	if len(parts) != 2 {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return start, true
+}
+
+// BeginUploadHandler starts a new resumable upload.
+// This is called with requests like `POST /uploads/`.
+func BeginUploadHandler(res http.ResponseWriter, req *http.Request) {
+	uuid, err := STORAGE.BeginUpload()
+	if err != nil {
+		http.Error(res, "failed to start upload", http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Location", "/uploads/"+uuid)
+	res.Header().Set("Range", "0-0")
+	res.WriteHeader(http.StatusAccepted)
+}
+
+// AppendUploadHandler appends a chunk to an in-progress upload.
+// This is called with requests like `PATCH /uploads/{uuid}`.
+func AppendUploadHandler(res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	uuid := vars["uuid"]
+
+	// Peek at the current offset, without appending anything, so we can validate the
+	// client's Content-Range before consuming its body.
+	current, err := STORAGE.AppendUpload(uuid, bytes.NewReader(nil))
+	if err != nil {
+		http.Error(res, "unknown upload", http.StatusNotFound)
+		return
+	}
+
+	if start, ok := parseContentRangeStart(req.Header.Get("Content-Range")); ok && start != current {
+		res.Header().Set("Range", fmt.Sprintf("0-%d", current))
+		res.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	n, err := STORAGE.AppendUpload(uuid, req.Body)
+	if err != nil {
+		http.Error(res, "failed to append to upload", http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Range", fmt.Sprintf("0-%d", n))
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// FinishUploadHandler finalizes a resumable upload, moving its scratch data into
+// place as a blob.  This is called with requests like
+// `PUT /uploads/{uuid}?digest=sha256:...`.
+func FinishUploadHandler(res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	uuid := vars["uuid"]
+
+	digest := req.URL.Query().Get("digest")
+	if digest == "" {
+		http.Error(res, "missing digest parameter", http.StatusBadRequest)
+		return
+	}
+
+	// digest becomes the final storage key, so it needs the same traversal-attack
+	// check UploadHandler applies to id - the filesystem back-end's chroot isn't
+	// there to save us once non-filesystem back-ends (S3/Swift/Redis) are in play.
+	if !idPattern.MatchString(digest) {
+		http.Error(res, "alphanumeric IDs only", http.StatusBadRequest)
+		return
+	}
+
+	if err := STORAGE.FinishUpload(uuid, digest); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	out := fmt.Sprintf("{\"digest\":\"%s\",\"status\":\"OK\"}", digest)
+	fmt.Fprintf(res, string(out))
+}
+
+// CancelUploadHandler discards an in-progress upload.
+// This is called with requests like `DELETE /uploads/{uuid}`.
+func CancelUploadHandler(res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	uuid := vars["uuid"]
+
+	if err := STORAGE.CancelUpload(uuid); err != nil {
+		http.Error(res, "unknown upload", http.StatusNotFound)
+		return
+	}
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// uploadSweeper is implemented by storage back-ends which keep scratch state for
+// resumable uploads around (on disk, or in the back-end itself) and so need to
+// garbage-collect abandoned ones.
+type uploadSweeper interface {
+	SweepUploads(ttl time.Duration)
+}
+
 // blobServer is our entry-point to the sub-command.
 func blobServer(options blobServerCmd) {
 	// Create a storage system.
-	STORAGE = new(FilesystemStorage)
+	switch options.backend {
+	case "s3":
+		STORAGE = new(S3Storage)
+	case "swift":
+		STORAGE = new(SwiftStorage)
+	case "redis":
+		STORAGE = new(RedisStorage)
+	default:
+		STORAGE = new(FilesystemStorage)
+	}
 	STORAGE.Setup(options.store)
 
+	// If our storage back-end accumulates scratch state for abandoned uploads,
+	// sweep it periodically.
+	if sweeper, ok := STORAGE.(uploadSweeper); ok {
+		go func() {
+			for {
+				time.Sleep(options.uploadTTL)
+				sweeper.SweepUploads(options.uploadTTL)
+			}
+		}()
+	}
+
 	// See https://github.com/gorilla/mux.
+	router := newBlobRouter()
+	http.Handle("/", router)
+
+	// Launch the server
+	fmt.Printf("blob-server available at http://%s:%d/\nUploads will be written beneath: %s\n",
+		options.host, options.port, options.store)
+	log.Fatal(http.ListenAndServe(fmt.Sprintf("%s:%d", options.host, options.port), nil))
+}
+
+// newBlobRouter wires up the blob-server's handlers against STORAGE.  Split out of
+// blobServer so tests can exercise the handlers unchanged via httptest, against
+// whichever StorageHandler they've set up.
+func newBlobRouter() *mux.Router {
 	router := mux.NewRouter()
 	router.HandleFunc("/alive", HealthHandler).Methods("GET")
 	router.HandleFunc("/blob/{id}", GetHandler).Methods("GET")
 	router.HandleFunc("/blob/{id}", GetHandler).Methods("HEAD")
 	router.HandleFunc("/blob/{id}", UploadHandler).Methods("POST")
+	router.HandleFunc("/blob", DigestUploadHandler).Methods("POST")
 	router.HandleFunc("/blobs", ListHandler).Methods("GET")
+	router.HandleFunc("/uploads/", BeginUploadHandler).Methods("POST")
+	router.HandleFunc("/uploads/{uuid}", AppendUploadHandler).Methods("PATCH")
+	router.HandleFunc("/uploads/{uuid}", FinishUploadHandler).Methods("PUT")
+	router.HandleFunc("/uploads/{uuid}", CancelUploadHandler).Methods("DELETE")
 	router.PathPrefix("/").HandlerFunc(MissingHandler)
-	http.Handle("/", router)
-
-	// Launch the server
-	fmt.Printf("blob-server available at http://%s:%d/\nUploads will be written beneath: %s\n",
-		options.host, options.port, options.store)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf("%s:%d", options.host, options.port), nil))
+	return router
 }
@@ -0,0 +1,115 @@
+// Replica placement and lookup for the API-server.
+//
+// The API-server no longer just tries blob-servers in order: it picks a fixed
+// number of replicas for each blob and writes to all of them. The blob's real
+// content-digest isn't known until the upload has been streamed through in full
+// (see chunk0-5), so placement can't be a deterministic function of it; replicas
+// are instead chosen uniformly at random from the known server-list.
+//
+// This supersedes chunk0-4's original ask for rendezvous (HRW) hashing of the
+// content-digest: HRW needs its key up front to pick servers before a single byte
+// goes out, but chunk0-5 requires streaming the upload straight through to its
+// replicas as it arrives, specifically so we're never holding the whole blob (and
+// so never know its digest) in memory. The two requirements can't both be met, so
+// this is a deliberate regression from "stable, digest-derived placement" to
+// "uniform random placement" rather than a rendezvous hash dressed up over a key
+// that isn't the digest - that middle ground would buy none of HRW's actual
+// benefit (minimal reshuffling as the server-list changes) while looking like it
+// does. If stable placement matters again later, the fix is upstream of here: have
+// the uploader hand us a pre-computed digest (or any other identifier known before
+// the body starts streaming) to hash on, rather than trying to recover it after
+// the fact.
+//
+// A lookupCache remembers where an upload landed so that downloads and the
+// /lookup/{id} endpoint can avoid re-probing every blob-server on every request.
+
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+
+	"github.com/skx/sos/libconfig"
+)
+
+// Location describes one blob-server a blob has been placed on.
+type Location struct {
+	Group string `json:"group"`
+	URL   string `json:"url"`
+}
+
+// lookupCache remembers, for each blob ID we've handled an upload for, which
+// blob-servers we placed it on.
+type lookupCache struct {
+	mu   sync.RWMutex
+	data map[string][]Location
+}
+
+// theLookupCache is the API-server's single, process-wide placement cache.
+var theLookupCache = &lookupCache{data: make(map[string][]Location)}
+
+func (c *lookupCache) put(id string, locations []Location) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data[id] = locations
+}
+
+func (c *lookupCache) get(id string) ([]Location, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	locations, ok := c.data[id]
+	return locations, ok
+}
+
+// pickReplicas selects n distinct blob-servers at random out of the full set of
+// known servers, to write a new upload to.
+func pickReplicas(servers []libconfig.Server, n int) []libconfig.Server {
+	shuffled := make([]libconfig.Server, len(servers))
+	copy(shuffled, servers)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	if n > len(shuffled) {
+		n = len(shuffled)
+	}
+	return shuffled[:n]
+}
+
+// probeLocations issues a parallel HEAD /blob/{id} against every known blob-server,
+// and returns the ones which reported having it.  This is the fallback used on a
+// lookup-cache miss, e.g. after an API-server restart.
+func probeLocations(id string) []Location {
+	servers := libconfig.Servers()
+
+	var wg sync.WaitGroup
+	found := make(chan Location, len(servers))
+
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s libconfig.Server) {
+			defer wg.Done()
+
+			req, err := http.NewRequest("HEAD", s.Location+"/blob/"+id, nil)
+			if err != nil {
+				return
+			}
+
+			client := &http.Client{}
+			r, err := client.Do(req)
+			if err == nil && r.StatusCode == http.StatusOK {
+				found <- Location{Group: s.Group, URL: s.Location}
+			}
+		}(s)
+	}
+
+	wg.Wait()
+	close(found)
+
+	var locations []Location
+	for l := range found {
+		locations = append(locations, l)
+	}
+	return locations
+}
@@ -11,19 +11,51 @@
 //
 // We also allow (optional) meta-data to be written/retrieved alongside the data.  The latter is
 // saved as a JSON file, alongside the data.
+//
+// IDs are opaque to this file except that "sha256:<hex>" IDs are checked against the
+// data by VerifyDigest (and by FinishUpload before it commits).  Callers are free to
+// use such content-digests as IDs, in which case storage becomes content-addressable: the same
+// content always lands at the same ID, and callers can verify what they fetched by
+// recomputing Digest() over it.
 
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 )
 
+// Digest computes the sha256 content-digest of the given data, in the "algo:hex" form
+// used by the Docker registry API, e.g. "sha256:e3b0c4...".
+func Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("sha256:%x", sum)
+}
+
+// VerifyDigest checks data against id, if and only if id is a recognised
+// content-digest (currently just "sha256:<hex>").  IDs which aren't in that form are
+// opaque to us and pass unconditionally - see the package comment above.
+func VerifyDigest(id string, data []byte) error {
+	idx := strings.Index(id, ":")
+	if idx == -1 || id[:idx] != "sha256" {
+		return nil
+	}
+	if got := Digest(data); got != id {
+		return fmt.Errorf("digest mismatch: expected %s, got %s", id, got)
+	}
+	return nil
+}
+
 // StorageHandler is the interface for a storage class.
 type StorageHandler interface {
 
@@ -45,6 +77,32 @@ type StorageHandler interface {
 
 	// Does the given ID exist?
 	Exists(id string) bool
+
+	// BeginUpload starts a new resumable upload and returns an opaque UUID
+	// identifying it.
+	BeginUpload() (string, error)
+
+	// AppendUpload appends the contents of r to the scratch data for the given
+	// upload UUID, and returns the new total offset.
+	AppendUpload(uuid string, r io.Reader) (int64, error)
+
+	// FinishUpload completes a resumable upload, committing its scratch data as the
+	// blob with the given ID.  If id is a recognised content-digest the scratch data
+	// is verified against it before being committed.
+	FinishUpload(uuid, id string) error
+
+	// CancelUpload discards an in-progress upload and any scratch data it holds.
+	CancelUpload(uuid string) error
+}
+
+// RangeStorage is implemented by storage back-ends that can serve a sub-range of a
+// blob without reading the whole thing into memory first.  It is optional: callers
+// should type-assert for it and fall back to Get() plus slicing when it's absent.
+type RangeStorage interface {
+	// GetRange returns a reader over length bytes of the blob starting at offset,
+	// along with the blob's total size.  Passing length 0 is a convenient way to
+	// learn just the total size.
+	GetRange(id string, offset, length int64) (io.ReadCloser, int64, error)
 }
 
 // FilesystemStorage is a concrete type which implements the StorageHandler interface.
@@ -127,7 +185,7 @@ func (fss *FilesystemStorage) Existing() []string {
 	for _, f := range files {
 		name := f.Name()
 
-		if !strings.HasSuffix(name, ".json") {
+		if name != uploadsDir && !strings.HasSuffix(name, ".json") {
 			list = append(list, name)
 		}
 	}
@@ -146,3 +204,191 @@ func (fss *FilesystemStorage) Exists(id string) bool {
 	}
 	return true
 }
+
+// uploadsDir is the subdirectory beneath the data-directory in which in-progress
+// resumable uploads keep their scratch data and state.
+const uploadsDir = "_uploads"
+
+// uploadState is the small on-disk record kept alongside each upload's scratch data,
+// so that offset and age survive a server restart.
+type uploadState struct {
+	Offset    int64     `json:"offset"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// uploadDir returns the directory holding the scratch data and state for the given
+// upload UUID.
+func (fss *FilesystemStorage) uploadDir(uuid string) string {
+	if fss.cwd == false {
+		return filepath.Join(fss.prefix, uploadsDir, uuid)
+	}
+	return filepath.Join(uploadsDir, uuid)
+}
+
+func (fss *FilesystemStorage) uploadStatePath(uuid string) string {
+	return filepath.Join(fss.uploadDir(uuid), "state.json")
+}
+
+func (fss *FilesystemStorage) uploadDataPath(uuid string) string {
+	return filepath.Join(fss.uploadDir(uuid), "data")
+}
+
+func (fss *FilesystemStorage) readUploadState(uuid string) (uploadState, error) {
+	var state uploadState
+	raw, err := ioutil.ReadFile(fss.uploadStatePath(uuid))
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(raw, &state)
+	return state, err
+}
+
+func (fss *FilesystemStorage) writeUploadState(uuid string, state uploadState) error {
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fss.uploadStatePath(uuid), raw, 0644)
+}
+
+// BeginUpload starts a new resumable upload, creating its scratch directory and
+// returning a UUID the caller will use for subsequent PATCH/PUT/DELETE requests.
+func (fss *FilesystemStorage) BeginUpload() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	uuid := fmt.Sprintf("%x", buf)
+
+	if err := os.MkdirAll(fss.uploadDir(uuid), 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(fss.uploadDataPath(uuid), []byte{}, 0644); err != nil {
+		return "", err
+	}
+
+	state := uploadState{StartedAt: time.Now()}
+	if err := fss.writeUploadState(uuid, state); err != nil {
+		return "", err
+	}
+
+	return uuid, nil
+}
+
+// AppendUpload appends the contents of r to the scratch data for uuid, updating
+// (and returning) its recorded offset.
+func (fss *FilesystemStorage) AppendUpload(uuid string, r io.Reader) (int64, error) {
+	state, err := fss.readUploadState(uuid)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := os.OpenFile(fss.uploadDataPath(uuid), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n, err := io.Copy(f, r)
+	if err != nil {
+		return 0, err
+	}
+
+	state.Offset += n
+	if err := fss.writeUploadState(uuid, state); err != nil {
+		return 0, err
+	}
+
+	return state.Offset, nil
+}
+
+// FinishUpload commits the scratch data for uuid as the blob with the given ID,
+// verifying it against id first if id is a recognised content-digest.
+func (fss *FilesystemStorage) FinishUpload(uuid, id string) error {
+	src := fss.uploadDataPath(uuid)
+
+	if idx := strings.Index(id, ":"); idx != -1 && id[:idx] == "sha256" {
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		if err := VerifyDigest(id, data); err != nil {
+			return err
+		}
+	}
+
+	target := id
+	if fss.cwd == false {
+		target = filepath.Join(fss.prefix, id)
+	}
+
+	if err := os.Rename(src, target); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(fss.uploadDir(uuid))
+}
+
+// CancelUpload discards an in-progress upload, removing its scratch directory.
+func (fss *FilesystemStorage) CancelUpload(uuid string) error {
+	return os.RemoveAll(fss.uploadDir(uuid))
+}
+
+// GetRange opens the blob with the given ID and returns a reader over length bytes
+// starting at offset, without reading the rest of the file into memory.
+func (fss *FilesystemStorage) GetRange(id string, offset, length int64) (io.ReadCloser, int64, error) {
+	target := id
+	if fss.cwd == false {
+		target = filepath.Join(fss.prefix, id)
+	}
+
+	f, err := os.Open(target)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	return &limitedFile{io.LimitReader(f, length), f}, info.Size(), nil
+}
+
+// limitedFile pairs a bounded view of an open file with the file itself, so that
+// closing the view also closes the underlying descriptor.
+type limitedFile struct {
+	io.Reader
+	io.Closer
+}
+
+// SweepUploads removes any in-progress upload whose state predates ttl.  It is meant
+// to be invoked periodically by a background goroutine so abandoned uploads don't
+// accumulate on disk indefinitely.
+func (fss *FilesystemStorage) SweepUploads(ttl time.Duration) {
+	dir := uploadsDir
+	if fss.cwd == false {
+		dir = filepath.Join(fss.prefix, uploadsDir)
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		state, err := fss.readUploadState(e.Name())
+		if err != nil || time.Since(state.StartedAt) > ttl {
+			fss.CancelUpload(e.Name())
+		}
+	}
+}
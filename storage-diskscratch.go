@@ -0,0 +1,118 @@
+// Shared disk-backed scratch storage for resumable uploads.
+//
+// S3 and Swift have no native appendable object, so both buffer an in-progress
+// upload on local disk beneath the system temp directory and only push it to the
+// real back-end once FinishUpload is called. diskScratchUploads is that buffering,
+// factored out since it was identical between the two beyond which directory it
+// used - embed it, set root in Setup, and BeginUpload/AppendUpload/CancelUpload/
+// SweepUploads come along for free to satisfy StorageHandler/uploadSweeper.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// diskScratchUploads is the directory beneath the system temp-dir holding scratch
+// state for all of one back-end's in-progress uploads.
+type diskScratchUploads struct {
+	root string
+}
+
+func (d *diskScratchUploads) dir(uuid string) string {
+	return filepath.Join(os.TempDir(), d.root, uuid)
+}
+
+func (d *diskScratchUploads) statePath(uuid string) string {
+	return filepath.Join(d.dir(uuid), "state.json")
+}
+
+func (d *diskScratchUploads) dataPath(uuid string) string {
+	return filepath.Join(d.dir(uuid), "data")
+}
+
+// BeginUpload starts a new resumable upload, returning its UUID.
+func (d *diskScratchUploads) BeginUpload() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	uuid := fmt.Sprintf("%x", buf)
+
+	if err := os.MkdirAll(d.dir(uuid), 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(d.dataPath(uuid), []byte{}, 0644); err != nil {
+		return "", err
+	}
+
+	state, err := json.Marshal(uploadState{StartedAt: time.Now()})
+	if err != nil {
+		return "", err
+	}
+	return uuid, ioutil.WriteFile(d.statePath(uuid), state, 0644)
+}
+
+// AppendUpload appends the contents of r to the scratch file for uuid.
+func (d *diskScratchUploads) AppendUpload(uuid string, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(d.dataPath(uuid), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return 0, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// readScratchData returns the buffered contents of an in-progress upload, for
+// FinishUpload to verify and push on to the real back-end.
+func (d *diskScratchUploads) readScratchData(uuid string) ([]byte, error) {
+	return ioutil.ReadFile(d.dataPath(uuid))
+}
+
+// CancelUpload discards an in-progress upload's scratch data.
+func (d *diskScratchUploads) CancelUpload(uuid string) error {
+	return os.RemoveAll(d.dir(uuid))
+}
+
+// SweepUploads removes the scratch directory of any in-progress upload whose state
+// predates ttl, so uploads abandoned (e.g. by a crashed client) don't accumulate on
+// local disk indefinitely.
+func (d *diskScratchUploads) SweepUploads(ttl time.Duration) {
+	root := filepath.Join(os.TempDir(), d.root)
+
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+
+		var state uploadState
+		raw, err := ioutil.ReadFile(d.statePath(e.Name()))
+		if err == nil {
+			err = json.Unmarshal(raw, &state)
+		}
+		if err != nil || time.Since(state.StartedAt) > ttl {
+			d.CancelUpload(e.Name())
+		}
+	}
+}
@@ -0,0 +1,243 @@
+// Storage-backend: Redis.
+//
+// This backend stores each blob's contents under the key "blob:{id}", and any
+// (optional) metadata as a hash at "blob:{id}:meta".  Existing() walks the
+// keyspace with SCAN rather than KEYS, so it stays cheap against a large, live
+// Redis instance.
+//
+// The connection-string passed to Setup is a DSN of the form:
+//
+//   redis://host:port/db
+//
+// Redis strings support APPEND natively, so in-progress resumable uploads are
+// kept as an appendable string at "upload:{uuid}" - no local scratch file is
+// needed, unlike the S3 and Swift backends. Its start time is tracked alongside it
+// at "upload:{uuid}:started", so SweepUploads can reap ones abandoned past their
+// TTL the same way those disk-backed back-ends do, just against Redis's keyspace
+// instead of a state.json sidecar.
+
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// redisScanCount is how many keys we ask Redis to examine per SCAN cursor step.
+const redisScanCount = 100
+
+// RedisStorage is a concrete type which implements the StorageHandler interface by
+// storing blobs as keys in a Redis instance.
+type RedisStorage struct {
+	pool *redis.Pool
+}
+
+// Setup parses the Redis DSN and creates a connection pool.
+func (rs *RedisStorage) Setup(connection string) {
+	u, err := url.Parse(connection)
+	if err != nil {
+		panic(err)
+	}
+
+	addr := u.Host
+	db := 0
+	if path := strings.TrimPrefix(u.Path, "/"); path != "" {
+		db, _ = strconv.Atoi(path)
+	}
+
+	rs.pool = &redis.Pool{
+		MaxIdle:     5,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr, redis.DialDatabase(db))
+		},
+	}
+}
+
+func (rs *RedisStorage) dataKey(id string) string            { return "blob:" + id }
+func (rs *RedisStorage) metaKey(id string) string            { return "blob:" + id + ":meta" }
+func (rs *RedisStorage) uploadKey(uuid string) string        { return "upload:" + uuid }
+func (rs *RedisStorage) uploadStartedKey(uuid string) string { return "upload:" + uuid + ":started" }
+
+// Get retrieves the contents, and any metadata hash, of the given blob.
+func (rs *RedisStorage) Get(id string) (*[]byte, map[string]string) {
+	conn := rs.pool.Get()
+	defer conn.Close()
+
+	data, err := redis.Bytes(conn.Do("GET", rs.dataKey(id)))
+	if err != nil {
+		return nil, nil
+	}
+
+	meta, err := redis.StringMap(conn.Do("HGETALL", rs.metaKey(id)))
+	if err != nil || len(meta) == 0 {
+		return &data, nil
+	}
+	return &data, meta
+}
+
+// Store writes the given data against the given blob ID.
+func (rs *RedisStorage) Store(id string, data []byte) bool {
+	conn := rs.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SET", rs.dataKey(id), data)
+	return err == nil
+}
+
+// Existing returns all known IDs, walking the keyspace with SCAN.
+func (rs *RedisStorage) Existing() []string {
+	conn := rs.pool.Get()
+	defer conn.Close()
+
+	var list []string
+	cursor := 0
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", "blob:*", "COUNT", redisScanCount))
+		if err != nil {
+			return list
+		}
+
+		cursor, _ = redis.Int(reply[0], nil)
+		keys, _ := redis.Strings(reply[1], nil)
+		for _, k := range keys {
+			if !strings.HasSuffix(k, ":meta") {
+				list = append(list, strings.TrimPrefix(k, "blob:"))
+			}
+		}
+
+		if cursor == 0 {
+			break
+		}
+	}
+	return list
+}
+
+// Exists tests whether the given ID exists as a key.
+func (rs *RedisStorage) Exists(id string) bool {
+	conn := rs.pool.Get()
+	defer conn.Close()
+
+	ok, _ := redis.Bool(conn.Do("EXISTS", rs.dataKey(id)))
+	return ok
+}
+
+// BeginUpload starts a new resumable upload, returning its UUID.
+func (rs *RedisStorage) BeginUpload() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	uuid := fmt.Sprintf("%x", buf)
+
+	conn := rs.pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("SET", rs.uploadKey(uuid), ""); err != nil {
+		return "", err
+	}
+
+	_, err := conn.Do("SET", rs.uploadStartedKey(uuid), time.Now().Unix())
+	return uuid, err
+}
+
+// AppendUpload appends the contents of r to the upload string for uuid, using
+// Redis's native APPEND, and returns the new total length.
+//
+// APPEND auto-vivifies its key, so without the EXISTS check below a bogus uuid would
+// silently start a brand new upload instead of erroring like the fs/S3/Swift
+// back-ends do when asked to open a scratch file that was never created.
+func (rs *RedisStorage) AppendUpload(uuid string, r io.Reader) (int64, error) {
+	conn := rs.pool.Get()
+	defer conn.Close()
+
+	exists, err := redis.Bool(conn.Do("EXISTS", rs.uploadKey(uuid)))
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, fmt.Errorf("unknown upload %s", uuid)
+	}
+
+	chunk, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := redis.Int64(conn.Do("APPEND", rs.uploadKey(uuid), chunk))
+	return n, err
+}
+
+// FinishUpload commits the upload string for uuid as the blob with the given ID,
+// verifying it against id first if id is a recognised content-digest.
+func (rs *RedisStorage) FinishUpload(uuid, id string) error {
+	conn := rs.pool.Get()
+	defer conn.Close()
+
+	data, err := redis.Bytes(conn.Do("GET", rs.uploadKey(uuid)))
+	if err != nil {
+		return err
+	}
+
+	if err := VerifyDigest(id, data); err != nil {
+		return err
+	}
+
+	if _, err := conn.Do("SET", rs.dataKey(id), data); err != nil {
+		return err
+	}
+
+	_, err = conn.Do("DEL", rs.uploadKey(uuid), rs.uploadStartedKey(uuid))
+	return err
+}
+
+// CancelUpload discards an in-progress upload.
+func (rs *RedisStorage) CancelUpload(uuid string) error {
+	conn := rs.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", rs.uploadKey(uuid), rs.uploadStartedKey(uuid))
+	return err
+}
+
+// SweepUploads discards any in-progress upload whose started-at timestamp predates
+// ttl, walking the keyspace with SCAN the same way Existing() does.
+func (rs *RedisStorage) SweepUploads(ttl time.Duration) {
+	conn := rs.pool.Get()
+	defer conn.Close()
+
+	cursor := 0
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", "upload:*:started", "COUNT", redisScanCount))
+		if err != nil {
+			return
+		}
+
+		cursor, _ = redis.Int(reply[0], nil)
+		keys, _ := redis.Strings(reply[1], nil)
+		for _, k := range keys {
+			uuid := strings.TrimSuffix(strings.TrimPrefix(k, "upload:"), ":started")
+
+			startedUnix, err := redis.Int64(conn.Do("GET", k))
+			if err != nil {
+				continue
+			}
+
+			if time.Since(time.Unix(startedUnix, 0)) > ttl {
+				rs.CancelUpload(uuid)
+			}
+		}
+
+		if cursor == 0 {
+			break
+		}
+	}
+}
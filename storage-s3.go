@@ -0,0 +1,154 @@
+// Storage-backend: Amazon S3.
+//
+// This backend stores each blob as an object in a single S3 bucket, optionally
+// beneath a key-prefix.  Metadata is stored as a sidecar "<key>.json" object, in
+// keeping with how FilesystemStorage keeps its metadata alongside the data.
+//
+// The connection-string passed to Setup is a DSN of the form:
+//
+//   s3://bucket/prefix?region=eu-west-1
+//
+// In-progress resumable uploads are buffered on local disk beneath the system
+// temporary directory, and only written to S3 once FinishUpload is called; S3 has
+// no native equivalent of an appendable object, so there is nothing cheaper to do.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3Storage is a concrete type which implements the StorageHandler interface by
+// storing blobs as objects in an Amazon S3 bucket. BeginUpload/AppendUpload/
+// CancelUpload/SweepUploads come from the embedded diskScratchUploads; only
+// FinishUpload's final push to S3 is backend-specific.
+type S3Storage struct {
+	bucket string
+	prefix string
+	client *s3.S3
+
+	diskScratchUploads
+}
+
+// Setup parses the S3 DSN and creates our S3 client.
+func (ss *S3Storage) Setup(connection string) {
+	u, err := url.Parse(connection)
+	if err != nil {
+		panic(err)
+	}
+
+	ss.bucket = u.Host
+	ss.prefix = strings.TrimPrefix(u.Path, "/")
+	ss.diskScratchUploads = diskScratchUploads{root: "sos-s3-uploads"}
+
+	region := u.Query().Get("region")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String(region)}))
+	ss.client = s3.New(sess)
+}
+
+// key builds the full object key for the given blob ID.
+func (ss *S3Storage) key(id string) string {
+	if ss.prefix == "" {
+		return id
+	}
+	return ss.prefix + "/" + id
+}
+
+// Get retrieves the contents, and any sidecar metadata, of the given blob.
+func (ss *S3Storage) Get(id string) (*[]byte, map[string]string) {
+	out, err := ss.client.GetObject(&s3.GetObjectInput{Bucket: &ss.bucket, Key: aws.String(ss.key(id))})
+	if err != nil {
+		return nil, nil
+	}
+	defer out.Body.Close()
+
+	data, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return nil, nil
+	}
+
+	var meta map[string]string
+	metaOut, err := ss.client.GetObject(&s3.GetObjectInput{Bucket: &ss.bucket, Key: aws.String(ss.key(id) + ".json")})
+	if err == nil {
+		defer metaOut.Body.Close()
+		if metaData, err := ioutil.ReadAll(metaOut.Body); err == nil {
+			meta = make(map[string]string)
+			json.Unmarshal(metaData, &meta)
+		}
+	}
+
+	return &data, meta
+}
+
+// Store writes the given data against the given blob ID.
+func (ss *S3Storage) Store(id string, data []byte) bool {
+	_, err := ss.client.PutObject(&s3.PutObjectInput{
+		Bucket: &ss.bucket,
+		Key:    aws.String(ss.key(id)),
+		Body:   bytes.NewReader(data),
+	})
+	return err == nil
+}
+
+// Existing returns all known IDs beneath our prefix.
+func (ss *S3Storage) Existing() []string {
+	var list []string
+
+	input := &s3.ListObjectsV2Input{Bucket: &ss.bucket}
+	if ss.prefix != "" {
+		input.Prefix = aws.String(ss.prefix + "/")
+	}
+
+	ss.client.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			key := *obj.Key
+			if ss.prefix != "" {
+				key = strings.TrimPrefix(key, ss.prefix+"/")
+			}
+			if !strings.HasSuffix(key, ".json") {
+				list = append(list, key)
+			}
+		}
+		return true
+	})
+
+	return list
+}
+
+// Exists tests whether the given ID exists as an object.
+func (ss *S3Storage) Exists(id string) bool {
+	_, err := ss.client.HeadObject(&s3.HeadObjectInput{Bucket: &ss.bucket, Key: aws.String(ss.key(id))})
+	return err == nil
+}
+
+// FinishUpload uploads the buffered scratch data to S3 as the blob with the given
+// ID, verifying it against id first if id is a recognised content-digest.
+func (ss *S3Storage) FinishUpload(uuid, id string) error {
+	data, err := ss.readScratchData(uuid)
+	if err != nil {
+		return err
+	}
+
+	if err := VerifyDigest(id, data); err != nil {
+		return err
+	}
+
+	if ok := ss.Store(id, data); !ok {
+		return fmt.Errorf("failed to upload %s to S3", id)
+	}
+
+	return ss.CancelUpload(uuid)
+}
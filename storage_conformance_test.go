@@ -0,0 +1,219 @@
+// Shared conformance suite for StorageHandler implementations.
+//
+// Rather than duplicating the same assertions in every backend's test file, each one
+// just does its own Setup() and hands the result to runStorageConformance, which
+// drives it exactly the way a real client would: over HTTP, against the blob-server's
+// handlers wired up by newBlobRouter(), unchanged.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// runStorageConformance exercises storage through the blob-server handlers, and
+// fails t if the backend doesn't behave the way every StorageHandler must.
+func runStorageConformance(t *testing.T, storage StorageHandler) {
+	STORAGE = storage
+
+	server := httptest.NewServer(newBlobRouter())
+	defer server.Close()
+
+	t.Run("PlainIDRoundTrip", func(t *testing.T) {
+		testPlainIDRoundTrip(t, server.URL)
+	})
+	t.Run("ContentDigestRoundTrip", func(t *testing.T) {
+		testContentDigestRoundTrip(t, server.URL)
+	})
+	t.Run("DigestMismatchRejected", func(t *testing.T) {
+		testDigestMismatchRejected(t, server.URL)
+	})
+	t.Run("ConditionalGet", func(t *testing.T) {
+		testConditionalGet(t, server.URL)
+	})
+	t.Run("ResumableUpload", func(t *testing.T) {
+		testResumableUpload(t, server.URL)
+	})
+	t.Run("UnknownUploadRejected", func(t *testing.T) {
+		testUnknownUploadRejected(t, server.URL)
+	})
+}
+
+func testPlainIDRoundTrip(t *testing.T, base string) {
+	id := "conformanceplainid"
+	body := []byte("hello, world")
+
+	resp, err := http.Post(base+"/blob/"+id, "application/octet-stream", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload: got status %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(base + "/blob/" + id)
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	defer resp.Body.Close()
+
+	got, _ := ioutil.ReadAll(resp.Body)
+	if string(got) != string(body) {
+		t.Fatalf("download: got %q, want %q", got, body)
+	}
+}
+
+func testContentDigestRoundTrip(t *testing.T, base string) {
+	body := []byte("content-addressable payload")
+	id := Digest(body)
+
+	resp, err := http.Post(base+"/blob/"+id, "application/octet-stream", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload: got status %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(base + "/blob/" + id)
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if digest := resp.Header.Get("Digest"); digest != id {
+		t.Fatalf("Digest header: got %q, want %q", digest, id)
+	}
+
+	got, _ := ioutil.ReadAll(resp.Body)
+	if string(got) != string(body) {
+		t.Fatalf("download: got %q, want %q", got, body)
+	}
+}
+
+func testDigestMismatchRejected(t *testing.T, base string) {
+	id := fmt.Sprintf("sha256:%x", "not the right digest")
+
+	resp, err := http.Post(base+"/blob/"+id, "application/octet-stream", strings.NewReader("wrong content"))
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("upload of mismatched digest: got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func testConditionalGet(t *testing.T, base string) {
+	body := []byte("etag me")
+	id := Digest(body)
+
+	resp, err := http.Post(base+"/blob/"+id, "application/octet-stream", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Get(base + "/blob/" + id)
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	etag := resp.Header.Get("ETag")
+	resp.Body.Close()
+	if etag == "" {
+		t.Fatal("expected an ETag header")
+	}
+
+	req, _ := http.NewRequest("GET", base+"/blob/"+id, nil)
+	req.Header.Set("If-None-Match", etag)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("conditional download: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("conditional download: got status %d, want %d", resp.StatusCode, http.StatusNotModified)
+	}
+}
+
+func testResumableUpload(t *testing.T, base string) {
+	chunks := [][]byte{[]byte("resumable "), []byte("upload "), []byte("payload")}
+	var whole []byte
+	for _, c := range chunks {
+		whole = append(whole, c...)
+	}
+	id := Digest(whole)
+
+	resp, err := http.Post(base+"/uploads/", "application/octet-stream", nil)
+	if err != nil {
+		t.Fatalf("begin upload: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("begin upload: got status %d", resp.StatusCode)
+	}
+	location := resp.Header.Get("Location")
+	if location == "" {
+		t.Fatal("begin upload: missing Location header")
+	}
+
+	offset := int64(0)
+	for _, chunk := range chunks {
+		req, _ := http.NewRequest("PATCH", base+location, strings.NewReader(string(chunk)))
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", offset, offset+int64(len(chunk))-1))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("append upload: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("append upload: got status %d", resp.StatusCode)
+		}
+		offset += int64(len(chunk))
+	}
+
+	req, _ := http.NewRequest("PUT", base+location+"?digest="+id, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("finish upload: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("finish upload: got status %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(base + "/blob/" + id)
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	defer resp.Body.Close()
+
+	got, _ := ioutil.ReadAll(resp.Body)
+	if string(got) != string(whole) {
+		t.Fatalf("download after resumable upload: got %q, want %q", got, whole)
+	}
+}
+
+// testUnknownUploadRejected checks that a PATCH against a UUID which was never
+// handed out by BeginUpload is rejected rather than silently accepted - a backend
+// whose AppendUpload auto-vivifies its scratch state (as Redis's APPEND does) would
+// otherwise start a new, unregistered upload instead of 404ing.
+func testUnknownUploadRejected(t *testing.T, base string) {
+	req, _ := http.NewRequest("PATCH", base+"/uploads/does-not-exist", strings.NewReader("chunk"))
+	req.Header.Set("Content-Range", "bytes 0-4/*")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("append to unknown upload: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("append to unknown upload: got status %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
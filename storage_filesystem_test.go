@@ -0,0 +1,20 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFilesystemStorageConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sos-fs-test")
+	if err != nil {
+		t.Fatalf("tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage := new(FilesystemStorage)
+	storage.Setup(dir)
+
+	runStorageConformance(t, storage)
+}
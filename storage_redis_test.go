@@ -0,0 +1,21 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestRedisStorageConformance runs the shared conformance suite against a real
+// Redis instance named by SOS_TEST_REDIS_DSN (e.g. "redis://127.0.0.1:6379/0"). It's
+// skipped when that isn't set, since there's no local Redis to test against.
+func TestRedisStorageConformance(t *testing.T) {
+	dsn := os.Getenv("SOS_TEST_REDIS_DSN")
+	if dsn == "" {
+		t.Skip("SOS_TEST_REDIS_DSN not set, skipping Redis backend conformance test")
+	}
+
+	storage := new(RedisStorage)
+	storage.Setup(dsn)
+
+	runStorageConformance(t, storage)
+}
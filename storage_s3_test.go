@@ -0,0 +1,21 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestS3StorageConformance runs the shared conformance suite against a real S3
+// bucket named by SOS_TEST_S3_DSN (e.g. "s3://my-test-bucket/sos-test?region=eu-west-1").
+// It's skipped when that isn't set, since there's no local S3 to test against.
+func TestS3StorageConformance(t *testing.T) {
+	dsn := os.Getenv("SOS_TEST_S3_DSN")
+	if dsn == "" {
+		t.Skip("SOS_TEST_S3_DSN not set, skipping S3 backend conformance test")
+	}
+
+	storage := new(S3Storage)
+	storage.Setup(dsn)
+
+	runStorageConformance(t, storage)
+}
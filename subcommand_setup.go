@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"time"
 
 	"github.com/google/subcommands"
 )
@@ -16,12 +17,13 @@ import (
 
 // Options which may be set via flags for the "api-server" subcommand.
 type apiServerCmd struct {
-	host    string
-	blob    string
-	dport   int
-	uport   int
-	dump    bool
-	verbose bool
+	host              string
+	blob              string
+	dport             int
+	uport             int
+	dump              bool
+	verbose           bool
+	replicationFactor int
 }
 
 func (*apiServerCmd) Name() string     { return "api-server" }
@@ -39,6 +41,7 @@ func (p *apiServerCmd) SetFlags(f *flag.FlagSet) {
 	f.IntVar(&p.uport, "upload-port", 9991, "The port to bind upon for uploading objects.")
 	f.BoolVar(&p.dump, "dump", false, "Dump configuration and exit?")
 	f.BoolVar(&p.verbose, "verbose", false, "Show more output from the API-server.")
+	f.IntVar(&p.replicationFactor, "replication-factor", 2, "The number of blob-servers to write each upload to.")
 }
 
 // Entry-point - pass control to the API-server setup function.
@@ -50,9 +53,11 @@ func (p *apiServerCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interfac
 
 // Options which may be set via flags for the "blob-server" subcommand.
 type blobServerCmd struct {
-	store string
-	port  int
-	host  string
+	store     string
+	port      int
+	host      string
+	backend   string
+	uploadTTL time.Duration
 }
 
 func (*blobServerCmd) Name() string     { return "blob-server" }
@@ -66,7 +71,9 @@ func (*blobServerCmd) Usage() string {
 func (p *blobServerCmd) SetFlags(f *flag.FlagSet) {
 	f.StringVar(&p.host, "host", "127.0.0.1", "The IP to listen upon")
 	f.IntVar(&p.port, "port", 3001, "The port to bind upon")
-	f.StringVar(&p.store, "store", "data", "The location to write the data  to")
+	f.StringVar(&p.store, "store", "data", "The location to write the data to, or a backend-specific DSN (e.g. s3://bucket/prefix?region=...) when -backend is not fs.")
+	f.StringVar(&p.backend, "backend", "fs", "The storage back-end to use: fs, s3, swift, or redis.")
+	f.DurationVar(&p.uploadTTL, "upload-ttl", 24*time.Hour, "How long an incomplete resumable upload may remain before it is garbage-collected.")
 }
 
 // Entry-point.